@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// archiveChunkSize 是归档流式下载的默认分片大小，复用分片会话的 ChunkSize 语义
+const archiveChunkSize = defaultChunkSize
+
+// downloadArchiveHandler 处理 downloadArchiveAction：按 SelectedFiles 打包成 tar/zip 归档，落盘成一个
+// 临时文件后注册为一个普通的 downloadSession（见 session.go），后续分片读取直接复用
+// downloadChunkAction/downloadSessionReaper，不再像最初那样维护一套平行的归档会话 map 和 reaper
+func downloadArchiveHandler(conn net.Conn, head headInfo) bool {
+	if len(SelectedFiles) == 0 {
+		return respCommonError(conn, "no files selected")
+	}
+
+	format := head.ArchiveFormat
+	if format == "" {
+		format = "tar"
+	}
+
+	sid := newSessionID()
+	archivePath := uploadSaveDir + "/" + sid + ".archive"
+	if err := buildArchive(archivePath, format, head.Compression); err != nil {
+		logrus.Error("build archive error: ", err)
+		return respCommonError(conn, ErrorInternal+": "+err.Error())
+	}
+
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		logrus.Error("stat archive error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+	sum, err := sha256File(archivePath)
+	if err != nil {
+		logrus.Error("hash archive error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+
+	downloadSessionsMu.Lock()
+	downloadSessions[sid] = &downloadSession{
+		SessionID:  sid,
+		DeviceID:   head.DeviceID,
+		Path:       archivePath,
+		FileSize:   info.Size(),
+		FileSHA256: sum,
+		ChunkSize:  archiveChunkSize,
+		CreatedAt:  time.Now(),
+		Ephemeral:  true,
+	}
+	downloadSessionsMu.Unlock()
+
+	var resp RespHead
+	resp.Code = 200
+	resp.DataType = DataTypeArchive
+	resp.DataLen = DataLenStreaming
+	resp.SessionID = sid
+	resp.ChunkSize = archiveChunkSize
+	resp.Msg = sum // 整体 SHA-256，供客户端做最终校验；之后按 downloadChunkAction 续传分片，断线重连无需重新打包
+	return sendHead(conn, resp) == nil
+}
+
+// buildArchive 把 SelectedFiles 按 sendFiles 相同的 SavePath 布局打进 dstPath 指向的 tar 或 zip 文件
+func buildArchive(dstPath, format, compression string) error {
+	if compression == CompressionZstd {
+		// zstd 压缩依赖外部库（github.com/klauspost/compress/zstd），尚未接入，明确拒绝而不是静默退化成不压缩
+		return fmt.Errorf("zstd compression is not supported yet")
+	}
+
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch format {
+	case "zip":
+		// zip 格式不支持外层再套一层 gzip，各条目的压缩方式由 buildZipArchive 决定
+		return buildZipArchive(out, compression)
+	default:
+		var w io.Writer = out
+		if compression == CompressionGzip {
+			gw := gzip.NewWriter(out)
+			defer gw.Close()
+			w = gw
+		}
+		return buildTarArchive(w)
+	}
+}
+
+func buildTarArchive(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for _, path1 := range SelectedFiles {
+		path1 = strings.ReplaceAll(path1, "\\", "/")
+		if err := filepath.Walk(path1, func(path2 string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			savePath := filepath.Join(filepath.Base(path1), strings.TrimPrefix(path2, path1))
+			f, err := os.Open(path2)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = savePath
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func buildZipArchive(out *os.File, compression string) error {
+	zw := zip.NewWriter(out)
+	defer zw.Close()
+
+	method := zip.Store
+	if compression == CompressionGzip {
+		// zip 不套外层 gzip：请求 gzip 时各条目改用 Deflate 压缩，否则按 Store 原样存储
+		method = zip.Deflate
+	}
+
+	for _, path1 := range SelectedFiles {
+		path1 = strings.ReplaceAll(path1, "\\", "/")
+		if err := filepath.Walk(path1, func(path2 string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			savePath := filepath.Join(filepath.Base(path1), strings.TrimPrefix(path2, path1))
+			f, err := os.Open(path2)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			hdr, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			hdr.Name = savePath
+			hdr.Method = method
+			zf, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(zf, f)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
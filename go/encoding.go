@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"unicode"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// encodingCandidate 是一个按 n-gram 评分逐个尝试的候选编码，RangeTable 是该编码文本里"合理"字符应当落入的
+// Unicode 区块，用来给相邻字符对（bigram）打分，从而区分解码结果落在不同文字区块的候选编码
+type encodingCandidate struct {
+	Name       string
+	Enc        encoding.Encoding
+	RangeTable *unicode.RangeTable
+}
+
+// encodingCandidates 是有序的候选列表（非 map），顺序本身就是平分时的决胜规则：越靠前越优先，
+// 结果不再依赖 Go 的 map 随机遍历顺序。ISO-8859-1 逐字节都能"成功解码"、任何输入都能打出高分，
+// 因此不在这里参与评分，只作为下面 detectAndConvertToUTF8 的最后兜底
+var encodingCandidates = []encodingCandidate{
+	{"GBK", simplifiedchinese.GBK, unicode.Han},
+	{"GB18030", simplifiedchinese.GB18030, unicode.Han},
+	{"Big5", traditionalchinese.Big5, unicode.Han},
+	{"Shift_JIS", japanese.ShiftJIS, rangeTableUnion(unicode.Hiragana, unicode.Katakana, unicode.Han)},
+	{"EUC-KR", korean.EUCKR, unicode.Hangul},
+	{"UTF-16LE", xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), nil},
+	{"UTF-16BE", xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), nil},
+}
+
+// minNgramScore 是候选编码被接受所需的最低 bigram 分数，低于这个分数的候选被当作"解码失败"处理
+const minNgramScore = 0.2
+
+// detectAndConvertToUTF8 对非法 UTF-8 的剪贴板文本做 BOM 嗅探 + n-gram 打分，转成 UTF-8。
+// 候选编码按固定顺序依次尝试，严格大于号加上固定遍历顺序保证了同样的输入每次都检测出同样的结果；
+// ISO-8859-1 只在所有候选都打不出合格分数时才作为最后兜底使用。
+func detectAndConvertToUTF8(body []byte) ([]byte, string, error) {
+	if name, ok := sniffBOM(body); ok {
+		converted, err := decodeAs(body, name)
+		return converted, name, err
+	}
+
+	bestName := ""
+	var bestScore float64
+	for _, c := range encodingCandidates {
+		converted, err := c.Enc.NewDecoder().Bytes(body)
+		if err != nil || bytes.ContainsRune(converted, '�') {
+			continue
+		}
+		score := ngramScore(converted, c.RangeTable)
+		if score > bestScore {
+			bestScore = score
+			bestName = c.Name
+		}
+	}
+	if bestName != "" && bestScore >= minNgramScore {
+		converted, err := decodeAs(body, bestName)
+		return converted, bestName, err
+	}
+
+	// 没有候选编码打出合格分数，退化到 ISO-8859-1 逐字节映射，至少保证不丢字节，
+	// 但这通常意味着检测失败，调用方应该把返回的编码名当作"最低置信度"对待
+	converted, err := decodeAs(body, "ISO-8859-1")
+	return converted, "ISO-8859-1", err
+}
+
+// rangeTableUnion 把多个 RangeTable 合并成一张表，用于"日文=假名+汉字"这种需要合并的场景。
+// unicode.Is 对长表做二分查找，要求区间有序且互不覆盖，而不同表的带步长区间会互相覆盖，
+// 所以先把每个区间展开成单点区间，再按 Lo 排序
+func rangeTableUnion(tables ...*unicode.RangeTable) *unicode.RangeTable {
+	var merged unicode.RangeTable
+	for _, t := range tables {
+		for _, r := range t.R16 {
+			for c := uint32(r.Lo); c <= uint32(r.Hi); c += uint32(r.Stride) {
+				merged.R16 = append(merged.R16, unicode.Range16{Lo: uint16(c), Hi: uint16(c), Stride: 1})
+			}
+		}
+		for _, r := range t.R32 {
+			for c := r.Lo; c <= r.Hi; c += r.Stride {
+				merged.R32 = append(merged.R32, unicode.Range32{Lo: c, Hi: c, Stride: 1})
+			}
+		}
+	}
+	sort.Slice(merged.R16, func(i, j int) bool { return merged.R16[i].Lo < merged.R16[j].Lo })
+	sort.Slice(merged.R32, func(i, j int) bool { return merged.R32[i].Lo < merged.R32[j].Lo })
+	return &merged
+}
+
+// sniffBOM 识别常见的字节序标记
+func sniffBOM(body []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return "UTF-8", true
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return "UTF-16LE", true
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return "UTF-16BE", true
+	}
+	return "", false
+}
+
+// decodeAs 按编码名转成 UTF-8，供已知 SourceEncoding 或探测结果复用
+func decodeAs(body []byte, name string) ([]byte, error) {
+	if name == "UTF-8" {
+		return body, nil
+	}
+	if name == "ISO-8859-1" {
+		runes := make([]rune, len(body))
+		for i, b := range body {
+			runes[i] = rune(b)
+		}
+		return []byte(string(runes)), nil
+	}
+	for _, c := range encodingCandidates {
+		if c.Name == name {
+			return c.Enc.NewDecoder().Bytes(body)
+		}
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", name)
+}
+
+// ngramScore 对解码结果做 bigram 打分：统计相邻字符对里，两个字符都落在该编码"合理字符区块"内的比例。
+// 比起单字符是否可打印，错误解码通常会在区块边界产生不连续的乱码字符对，bigram 比例会明显更低。
+// GBK 和 GB18030 对两者共有的字节序列解码结果相同，打分持平，由 encodingCandidates 的顺序决定；
+// 含 GB18030 四字节序列的文本在 GBK 下会解出替换字符，在 detectAndConvertToUTF8 里直接被跳过。
+// RangeTable 为 nil（如 UTF-16）时退化为统计可打印字符的单字符比例。
+func ngramScore(s []byte, table *unicode.RangeTable) float64 {
+	runes := []rune(string(s))
+	if len(runes) == 0 {
+		return 0
+	}
+	if table == nil {
+		return printableRatio(runes)
+	}
+	if len(runes) == 1 {
+		if unicode.Is(table, runes[0]) {
+			return 1
+		}
+		return 0
+	}
+
+	var matched, total int
+	for i := 0; i < len(runes)-1; i++ {
+		total++
+		if unicode.Is(table, runes[i]) && unicode.Is(table, runes[i+1]) {
+			matched++
+		}
+	}
+	return float64(matched) / float64(total)
+}
+
+// printableRatio 是没有专属 Unicode 区块可比对时的退化打分：可打印字符占比越高，说明转码越可能正确
+func printableRatio(runes []rune) float64 {
+	var printable int
+	for _, r := range runes {
+		if r == '\n' || r == '\r' || r == '\t' || (r >= 0x20 && r < 0x10000) {
+			printable++
+		}
+	}
+	return float64(printable) / float64(len(runes))
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/doraemonkeys/clipboard-go/language"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.design/x/clipboard"
+)
+
+// X-WindSend-Auth 头的格式为 hex(time)|hex(hmac)，hmac 对 "time|clientIP" 做 HMAC-SHA256
+const authHeader = "X-WindSend-Auth"
+
+// X-WindSend-Device 头携带配对设备的 DeviceID，和 TCP 侧 headInfo.DeviceID 同一语义：非空时
+// authHeader 的 HMAC 改用这台设备的 SharedKey 校验，并按 deviceAllows 做权限位检查；留空走
+// 旧版全局密钥，行为和改造前完全一致，迁移期间新旧网关客户端可以共存
+const deviceHeader = "X-WindSend-Device"
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// 浏览器/第三方客户端可能来自任意源，具体的访问控制由 gatewayAuth 负责
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// gatewayAddr 是 WebSocket/REST 网关监听的地址，和 TCP 协议监听端口分开
+var gatewayAddr = ":8444"
+
+func init() {
+	go func() {
+		if err := StartGateway(gatewayAddr); err != nil {
+			logrus.Error("gateway exited: ", err)
+		}
+	}()
+}
+
+// StartGateway 在 addr 上监听 WebSocket 与 HTTP/REST 网关，与 mainProcess 共用同一套 auth+action 语义
+func StartGateway(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", wsHandler)
+	mux.HandleFunc("/paste/text", gatewayAuth(restPasteTextHandler))
+	mux.HandleFunc("/copy", gatewayAuth(restCopyHandler))
+	mux.HandleFunc("/paste/file", gatewayAuth(restPasteFileHandler))
+	mux.HandleFunc("/files/list", gatewayAuth(restListHandler))
+	mux.HandleFunc("/files/download", restSignedFileHandler)
+	mux.HandleFunc("/files/thumb", restThumbHandler)
+
+	logrus.Info("gateway listening on ", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// gatewayAuth 校验 X-WindSend-Auth/X-WindSend-Device，通过后把解析出的 *PairedDevice
+// （旧版全局密钥路径下为 nil）透传给下一层 handler，由 handler 自己在知道具体 action/Path/
+// FileSize 之后调用 gatewayCheckPermission
+func gatewayAuth(next func(w http.ResponseWriter, r *http.Request, device *PairedDevice)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.RemoteAddr
+		if idx := strings.LastIndex(clientIP, ":"); idx != -1 {
+			clientIP = clientIP[:idx]
+		}
+		device, _, err := verifyGatewayAuth(r.Header.Get(authHeader), clientIP, r.Header.Get(deviceHeader))
+		if err != nil {
+			logrus.Info("gateway auth failed: ", err)
+			http.Error(w, ErrorInvalidAuthData, http.StatusUnauthorized)
+			return
+		}
+		next(w, r, device)
+	}
+}
+
+// verifyGatewayAuth 校验 "hexTime|hexHMAC" 形式的 authHeader，HMAC 覆盖 "time|clientIP"。
+// deviceID 非空时按 lookupActiveDevice 解析配对设备，HMAC 密钥用这台设备的 SharedKey（和
+// TCP 侧 commonAuth 的 usesPairedKey 分支同一套信任模型，见 pairing.go）；deviceID 为空则
+// 退回旧版全局密钥，返回的 *PairedDevice 为 nil，调用方据此知道要不要跑 deviceAllows
+func verifyGatewayAuth(header string, clientIP string, deviceID string) (*PairedDevice, bool, error) {
+	if deviceID != "" {
+		device, ok := lookupActiveDevice(deviceID)
+		if !ok {
+			return nil, false, errors.New(ErrorDeviceForbidden)
+		}
+		if err := verifyGatewayHMAC(header, clientIP, device.SharedKey); err != nil {
+			return nil, false, err
+		}
+		touchDeviceLastSeen(device.ID)
+		return device, true, nil
+	}
+	secretKey, err := hex.DecodeString(GloballCnf.SecretKeyHex)
+	if err != nil {
+		return nil, false, errors.New("invalid secret key: " + err.Error())
+	}
+	if err := verifyGatewayHMAC(header, clientIP, secretKey); err != nil {
+		return nil, false, err
+	}
+	return nil, false, nil
+}
+
+// verifyGatewayHMAC 校验 authHeader 的时间窗口（复用 MaxTimeDiff）和 HMAC-SHA256("time|clientIP")
+func verifyGatewayHMAC(header string, clientIP string, key []byte) error {
+	parts := strings.SplitN(header, "|", 2)
+	if len(parts) != 2 {
+		return errors.New("malformed auth header")
+	}
+	unixSec, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return errors.New("malformed time: " + err.Error())
+	}
+	t := time.Unix(unixSec, 0)
+	if time.Since(t).Seconds() > MaxTimeDiff {
+		return errors.New("auth expired: " + t.String())
+	}
+	given, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed hmac: " + err.Error())
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "|" + clientIP))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("hmac mismatch")
+	}
+	return nil
+}
+
+// gatewayCheckPermission 是 deviceAllows 在网关侧的入口：device 为 nil（旧版全局密钥）时直接
+// 放行，和 commonAuth 对 usesPairedKey==false 的处理保持一致；否则按 head 描述的 action/Path/
+// FileSize 走同一套 deviceAllows 权限位，拒绝时写 403 并返回 false 供调用方直接 return
+func gatewayCheckPermission(w http.ResponseWriter, device *PairedDevice, head headInfo) bool {
+	if device == nil {
+		return true
+	}
+	if !deviceAllows(device, head) {
+		http.Error(w, ErrorPermissionDenied, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// wsHandler 把一条 WebSocket 连接桥接成 headInfo/RespHead 控制帧 + 二进制负载帧，复用 TCP 一侧的 action 语义
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.RemoteAddr
+	if idx := strings.LastIndex(clientIP, ":"); idx != -1 {
+		clientIP = clientIP[:idx]
+	}
+	device, usesPairedKey, err := verifyGatewayAuth(r.Header.Get(authHeader), clientIP, r.Header.Get(deviceHeader))
+	if err != nil {
+		logrus.Info("ws auth failed: ", err)
+		http.Error(w, ErrorInvalidAuthData, http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.Error("ws upgrade error: ", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		var head headInfo
+		if err := conn.ReadJSON(&head); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logrus.Info("ws read control frame error: ", err)
+			}
+			return
+		}
+
+		var body []byte
+		if head.DataLen > 0 {
+			msgType, payload, err := conn.ReadMessage()
+			if err != nil || msgType != websocket.BinaryMessage {
+				logrus.Info("ws read payload frame error: ", err)
+				return
+			}
+			body = payload
+		}
+
+		// 升级时只验证了身份，不代表每一帧都在这台设备的权限范围内——每条控制帧都要重新过一遍
+		// deviceAllows，和 commonAuth 对 TCP 每个请求都校验一遍是同一个道理
+		if usesPairedKey && !deviceAllows(device, head) {
+			conn.WriteJSON(RespHead{Code: 403, Msg: ErrorPermissionDenied})
+			continue
+		}
+
+		resp, respBody := handleGatewayAction(head, body)
+		if err := conn.WriteJSON(resp); err != nil {
+			logrus.Info("ws write control frame error: ", err)
+			return
+		}
+		if len(respBody) > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, respBody); err != nil {
+				logrus.Info("ws write payload frame error: ", err)
+				return
+			}
+		}
+	}
+}
+
+// handleGatewayAction 执行一个 action 并以内存形式返回结果，供 WebSocket 和 REST 两种传输共用
+func handleGatewayAction(head headInfo, body []byte) (RespHead, []byte) {
+	switch head.Action {
+	case pasteTextAction:
+		// 和 route.go 的 pasteTextHandler 保持一致：浏览器/第三方客户端恰恰最容易带着
+		// GBK/Big5/Shift-JIS 之类的非 UTF-8 文本过来，网关也要跑一遍编码检测，而不只是 TCP 侧
+		detectedEncoding := ""
+		var err error
+		if head.SourceEncoding != "" {
+			// 客户端声明了编码时按声明转码，不受 DisableEncodingDetect 影响
+			body, err = decodeAs(body, head.SourceEncoding)
+			if err != nil {
+				logrus.Error("decode as declared encoding error: ", err)
+			} else {
+				detectedEncoding = head.SourceEncoding
+			}
+		} else if GloballCnf.DisableEncodingDetect {
+			// 配置关闭了自动检测，未声明编码的文本按 UTF-8 原样处理
+		} else if !utf8.Valid(body) {
+			body, detectedEncoding, err = detectAndConvertToUTF8(body)
+			if err != nil {
+				logrus.Error("detect encoding error: ", err)
+			}
+		}
+
+		clipboard.Write(clipboard.FmtText, body)
+		Inform(string(body), head.DeviceName)
+		msg := "粘贴成功"
+		if detectedEncoding != "" {
+			msg += "（检测到编码：" + detectedEncoding + "）"
+		}
+		return RespHead{Code: 200, Msg: msg}, nil
+	case copyAction:
+		switch clipboarDataType {
+		case clipboardWatchDataTypeText:
+			return RespHead{Code: 200, DataType: DataTypeText, DataLen: int64(len(clipboardWatchData))}, clipboardWatchData
+		case clipboardWatchDataTypeImage:
+			return RespHead{Code: 200, DataType: DataTypeClipImage, DataLen: int64(len(clipboardWatchData))}, clipboardWatchData
+		default:
+			return RespHead{Code: 400, Msg: language.Translate(language.ClipboardIsEmpty)}, nil
+		}
+	default:
+		return RespHead{Code: 400, Msg: "unknown action:" + head.Action}, nil
+	}
+}
+
+func restPasteTextHandler(w http.ResponseWriter, r *http.Request, device *PairedDevice) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, ErrorIncompleteData, http.StatusBadRequest)
+		return
+	}
+	head := headInfo{Action: pasteTextAction, DeviceName: webIp, FileSize: int64(len(body))}
+	if !gatewayCheckPermission(w, device, head) {
+		return
+	}
+	resp, _ := handleGatewayAction(head, body)
+	writeJSONResp(w, resp)
+}
+
+func restCopyHandler(w http.ResponseWriter, r *http.Request, device *PairedDevice) {
+	head := headInfo{Action: copyAction}
+	if !gatewayCheckPermission(w, device, head) {
+		return
+	}
+	resp, body := handleGatewayAction(head, nil)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-WindSend-DataType", resp.DataType)
+	if resp.Code != 200 {
+		writeJSONResp(w, resp)
+		return
+	}
+	w.Write(body)
+}
+
+// restPasteFileHandler 接受 multipart/form-data 上传，小文件直接落盘，大文件建议走 chunk session 协议
+func restPasteFileHandler(w http.ResponseWriter, r *http.Request, device *PairedDevice) {
+	if err := r.ParseMultipartForm(singleShotMaxFileSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if !gatewayCheckPermission(w, device, headInfo{Action: pasteFileAction, FileSize: header.Size}) {
+		return
+	}
+
+	// 只取 multipart filename 的 base 部分，避免 "../../..." 之类的越权写入
+	savePath, err := resolveUploadPath(filepath.Base(header.Filename))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := os.Create(savePath)
+	if err != nil {
+		http.Error(w, ErrorInternal, http.StatusInternalServerError)
+		return
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, file); err != nil {
+		http.Error(w, ErrorIncompleteData, http.StatusBadRequest)
+		return
+	}
+	writeJSONResp(w, RespHead{Code: 200, Msg: "粘贴成功"})
+}
+
+// restListHandler 是 listAction 的 HTTP 等价物，复用同一套白名单校验、分页和签名 URL 生成逻辑
+func restListHandler(w http.ResponseWriter, r *http.Request, device *PairedDevice) {
+	q := r.URL.Query()
+	start, _ := strconv.ParseInt(q.Get("start"), 10, 64)
+	end, _ := strconv.ParseInt(q.Get("end"), 10, 64)
+	head := headInfo{
+		Action: listAction,
+		Path:   q.Get("path"),
+		Start:  start,
+		End:    end,
+		SortBy: q.Get("sortBy"),
+		Filter: q.Get("filter"),
+	}
+	if !gatewayCheckPermission(w, device, head) {
+		return
+	}
+
+	path, err := resolveAllowedPath(head.Path)
+	if err != nil {
+		writeJSONResp(w, RespHead{Code: 400, Msg: err.Error()})
+		return
+	}
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		writeJSONResp(w, RespHead{Code: 400, Msg: err.Error()})
+		return
+	}
+
+	entries := make([]browseEntry, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		if head.Filter != "" && !strings.Contains(strings.ToLower(de.Name()), strings.ToLower(head.Filter)) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entryPath := filepath.Join(path, de.Name())
+		entry := browseEntry{Name: de.Name(), Size: info.Size(), IsDir: de.IsDir(), Modified: info.ModTime()}
+		if !de.IsDir() {
+			entry.Mime = detectMime(entryPath)
+			entry.DownloadURL = signedFileURL("/files/download", entryPath)
+			// 和 browse.go 的 listHandler 保持一致：视频缩略图还没实现，不要挂一个必然 400 的链接
+			if strings.HasPrefix(entry.Mime, "image/") {
+				entry.ThumbURL = signedFileURL("/files/thumb", entryPath)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sortEntries(entries, head.SortBy)
+	lo, hi := paginate(head.Start, head.End, int64(len(entries)))
+	writeJSONResp(w, RespHead{Code: 200, Entries: entries[lo:hi]})
+}
+
+// restSignedFileHandler 和 restThumbHandler 用 sign= 查询参数代替持有 TCP 会话，供浏览器直接拉取文件/缩略图
+func restSignedFileHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if err := verifySignedPath(path, r.URL.Query().Get("exp"), r.URL.Query().Get("sign")); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+func restThumbHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if err := verifySignedPath(path, r.URL.Query().Get("exp"), r.URL.Query().Get("sign")); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	thumbPath, err := buildThumbnail(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.ServeFile(w, r, thumbPath)
+}
+
+func writeJSONResp(w http.ResponseWriter, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.Error("write json resp error: ", err)
+	}
+}
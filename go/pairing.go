@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/sirupsen/logrus"
+)
+
+// devicesFilePath 持久化已配对设备的存储文件
+const devicesFilePath = "paired_devices.json"
+
+// defaultDeviceExpire 是新配对设备的默认有效期，到期后需要重新配对
+const defaultDeviceExpire = 365 * 24 * time.Hour
+
+// DevicePermissions 是每个配对设备各自的操作许可范围
+type DevicePermissions struct {
+	CanPaste     bool     `json:"canPaste"`
+	CanCopy      bool     `json:"canCopy"`
+	CanListPaths bool     `json:"canListPaths"`
+	AllowedRoots []string `json:"allowedRoots"`
+	MaxFileSize  int64    `json:"maxFileSize"`
+	// CanAdmin 控制列出/重命名/吊销*其它*设备这类管理面操作，必须显式授予，不随配对自动获得
+	CanAdmin bool `json:"canAdmin"`
+}
+
+// defaultDevicePermissions 是配对成功后赋予新设备的默认权限：可以收发剪切板，但不能浏览目录、不能管理其它设备，体现"默认最小授权"
+var defaultDevicePermissions = DevicePermissions{
+	CanPaste:     true,
+	CanCopy:      true,
+	CanListPaths: false,
+	CanAdmin:     false,
+	MaxFileSize:  1 << 30, // 1GiB
+}
+
+// PairedDevice 是一台已完成配对的对端设备
+type PairedDevice struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	PublicKey   string            `json:"publicKey"` // hex 编码的 X25519 公钥
+	SharedKey   []byte            `json:"sharedKey"` // HKDF 派生出的对称密钥，仅服务端持久化，不在网络上传输
+	Permissions DevicePermissions `json:"permissions"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	LastSeen    time.Time         `json:"lastSeen"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Revoked     bool              `json:"revoked"`
+}
+
+var (
+	pairedDevicesMu sync.Mutex
+	pairedDevices   = make(map[string]*PairedDevice)
+)
+
+func init() {
+	if err := loadPairedDevices(); err != nil {
+		logrus.Warn("load paired devices error: ", err)
+	}
+}
+
+func loadPairedDevices() error {
+	buf, err := os.ReadFile(devicesFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pairedDevicesMu.Lock()
+	defer pairedDevicesMu.Unlock()
+	return json.Unmarshal(buf, &pairedDevices)
+}
+
+func savePairedDevices() error {
+	pairedDevicesMu.Lock()
+	buf, err := json.Marshal(pairedDevices)
+	pairedDevicesMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(devicesFilePath, buf, 0600)
+}
+
+// pairDevice 处理 matchAction 中的 X25519 配对：服务端生成一次性密钥对，与客户端公钥做 ECDH，
+// 再用 HKDF 派生出这台设备专属的对称密钥，替代过去所有设备共享的 GloballCnf.SecretKeyHex
+func pairDevice(head headInfo) (MatchActionResp, error) {
+	clientPubBytes, err := hex.DecodeString(head.ClientPublicKey)
+	if err != nil {
+		return MatchActionResp{}, fmt.Errorf("invalid client public key: %w", err)
+	}
+
+	curve := ecdh.X25519()
+	clientPub, err := curve.NewPublicKey(clientPubBytes)
+	if err != nil {
+		return MatchActionResp{}, fmt.Errorf("invalid client public key: %w", err)
+	}
+	serverPriv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return MatchActionResp{}, err
+	}
+	shared, err := serverPriv.ECDH(clientPub)
+	if err != nil {
+		return MatchActionResp{}, fmt.Errorf("ecdh error: %w", err)
+	}
+
+	sharedKey, err := deriveSharedKey(shared, head.ClientPublicKey)
+	if err != nil {
+		return MatchActionResp{}, err
+	}
+
+	now := time.Now()
+	device := &PairedDevice{
+		ID:          newSessionID(),
+		Name:        head.DeviceName,
+		PublicKey:   head.ClientPublicKey,
+		SharedKey:   sharedKey,
+		Permissions: defaultDevicePermissions,
+		CreatedAt:   now,
+		LastSeen:    now,
+		ExpiresAt:   now.Add(defaultDeviceExpire),
+	}
+
+	pairedDevicesMu.Lock()
+	// 配对面板此时还没有任何设备，说明这是刚初始化的主机在配对自己的第一台设备，而不是
+	// 陌生人趁 allowSearch 打开的窗口抢配对；给它 CanAdmin，否则 listDevices/renameDevice/
+	// revokeDevice 永远没有一台能打开它们的设备。之后配对的设备都走 defaultDevicePermissions，
+	// 管理员可以用这台第一台设备去给别的设备提权，或者提前把设备名写进
+	// GloballCnf.AdminDeviceNames，不依赖配对顺序
+	if len(pairedDevices) == 0 {
+		device.Permissions.CanAdmin = true
+	}
+	for _, name := range GloballCnf.AdminDeviceNames {
+		if name == head.DeviceName {
+			device.Permissions.CanAdmin = true
+		}
+	}
+	pairedDevices[device.ID] = device
+	pairedDevicesMu.Unlock()
+	if err := savePairedDevices(); err != nil {
+		logrus.Error("save paired devices error: ", err)
+	}
+
+	return MatchActionResp{
+		DeviceName:      GetDeviceName(),
+		ServerPublicKey: hex.EncodeToString(serverPriv.PublicKey().Bytes()),
+		DeviceID:        device.ID,
+	}, nil
+}
+
+// deriveSharedKey 用 HKDF-SHA256 从 ECDH 共享密钥派生出 32 字节的 AES-256-GCM 密钥，salt 取客户端公钥防止跨设备重用
+func deriveSharedKey(secret []byte, salt string) ([]byte, error) {
+	reader := hkdf.New(sha256.New, secret, []byte(salt), []byte("windsend-pairing-v1"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// lookupActiveDevice 按 deviceID 查找仍然有效（未吊销、未过期）的设备；deviceID 为空表示走旧的全局密钥路径
+func lookupActiveDevice(deviceID string) (*PairedDevice, bool) {
+	if deviceID == "" {
+		return nil, false
+	}
+	pairedDevicesMu.Lock()
+	device, ok := pairedDevices[deviceID]
+	pairedDevicesMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if device.Revoked || time.Now().After(device.ExpiresAt) {
+		return nil, false
+	}
+	return device, true
+}
+
+func touchDeviceLastSeen(deviceID string) {
+	pairedDevicesMu.Lock()
+	defer pairedDevicesMu.Unlock()
+	if device, ok := pairedDevices[deviceID]; ok {
+		device.LastSeen = time.Now()
+	}
+}
+
+// deviceAllows 按 action 把 head 映射到对应的权限位，在 allowedRoots/maxFileSize 上做额外约束
+func deviceAllows(device *PairedDevice, head headInfo) bool {
+	switch head.Action {
+	case pasteTextAction, pasteFileAction, createUploadSessionAction, uploadChunkAction:
+		if !device.Permissions.CanPaste {
+			return false
+		}
+		if device.Permissions.MaxFileSize > 0 && head.FileSize > device.Permissions.MaxFileSize {
+			return false
+		}
+	case copyAction, downloadAction, downloadArchiveAction, createDownloadSessionAction, downloadChunkAction:
+		if !device.Permissions.CanCopy {
+			return false
+		}
+	case listSessionsAction, abortSessionAction:
+		// 会话可能是上传会话也可能是下载会话，这里只把住"这台设备至少有收或发的权限"这一道闸；
+		// 具体到某一个 SessionID 是不是这台设备自己创建的，由 session.go 的
+		// abortSessionHandler/listSessionsHandler 按 DeviceID 过滤/拒绝
+		if !device.Permissions.CanPaste && !device.Permissions.CanCopy {
+			return false
+		}
+	case listAction:
+		if !device.Permissions.CanListPaths {
+			return false
+		}
+		// 复用 browse.go 的 pathWithinRoots：它按 filepath.Abs + 分隔符边界比较，不是裸前缀匹配，
+		// 否则 "/data/foo-private" 会被误判为落在 AllowedRoots 里的 "/data/foo" 之下
+		if _, ok := pathWithinRoots(head.Path, device.Permissions.AllowedRoots); !ok {
+			return false
+		}
+	case listDevicesAction, renameDeviceAction, revokeDeviceAction, setDevicePermissionsAction:
+		if !device.Permissions.CanAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+// isAdminAction 标记设备管理面的几个 action：它们能改变/读出*其它*设备的状态，权限要求比 deviceAllows
+// 里其它 case 更高，而且持有旧版全局密钥（usesPairedKey==false）的调用方完全没有设备身份可言，
+// 不能靠 deviceAllows 的默认分支放行——commonAuth 对这几个 action 单独兜底拒绝
+func isAdminAction(action string) bool {
+	switch action {
+	case listDevicesAction, renameDeviceAction, revokeDeviceAction, setDevicePermissionsAction:
+		return true
+	}
+	return false
+}
+
+// DeviceInfo 是 listDevicesAction 返回给管理端的设备摘要，不含 SharedKey 等敏感字段
+type DeviceInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// listDevicesHandler/renameDeviceHandler/revokeDeviceHandler/setPermissionsHandler 构成管理员查看、
+// 重命名、吊销设备、调整权限的最小管理面
+
+func listDevicesHandler(conn net.Conn, head headInfo) bool {
+	pairedDevicesMu.Lock()
+	var resp RespHead
+	resp.Code = 200
+	for _, device := range pairedDevices {
+		resp.Devices = append(resp.Devices, DeviceInfo{
+			ID:        device.ID,
+			Name:      device.Name,
+			CreatedAt: device.CreatedAt,
+			LastSeen:  device.LastSeen,
+			ExpiresAt: device.ExpiresAt,
+			Revoked:   device.Revoked,
+		})
+	}
+	pairedDevicesMu.Unlock()
+	return sendHead(conn, resp) == nil
+}
+
+func renameDeviceHandler(conn net.Conn, head headInfo) bool {
+	pairedDevicesMu.Lock()
+	device, ok := pairedDevices[head.DeviceID]
+	if ok {
+		device.Name = head.DeviceName
+	}
+	pairedDevicesMu.Unlock()
+	if !ok {
+		return respCommonError(conn, "unknown device: "+head.DeviceID)
+	}
+	if err := savePairedDevices(); err != nil {
+		logrus.Error("save paired devices error: ", err)
+	}
+	return sendMsg(conn, "renamed") == nil
+}
+
+// setPermissionsHandler 处理 setDevicePermissionsAction：管理员通过一台 CanAdmin 设备修改
+// 另一台设备的权限，是 CanAdmin 自举之后唯一能把权限再分发下去的入口
+func setPermissionsHandler(conn net.Conn, head headInfo) bool {
+	if head.Permissions == nil {
+		return respCommonError(conn, "missing permissions")
+	}
+	pairedDevicesMu.Lock()
+	device, ok := pairedDevices[head.DeviceID]
+	if ok {
+		device.Permissions = *head.Permissions
+	}
+	pairedDevicesMu.Unlock()
+	if !ok {
+		return respCommonError(conn, "unknown device: "+head.DeviceID)
+	}
+	if err := savePairedDevices(); err != nil {
+		logrus.Error("save paired devices error: ", err)
+	}
+	return sendMsg(conn, "permissions updated") == nil
+}
+
+func revokeDeviceHandler(conn net.Conn, head headInfo) bool {
+	pairedDevicesMu.Lock()
+	device, ok := pairedDevices[head.DeviceID]
+	if ok {
+		device.Revoked = true
+	}
+	pairedDevicesMu.Unlock()
+	if !ok {
+		return respCommonError(conn, "unknown device: "+head.DeviceID)
+	}
+	if err := savePairedDevices(); err != nil {
+		logrus.Error("save paired devices error: ", err)
+	}
+	return sendMsg(conn, "revoked") == nil
+}
+
+// aesGCMEncrypt/aesGCMDecrypt 是配对设备专属的对称加解密，和全局 crypter 一样用 AES-GCM，
+// 但密钥是每台设备各自派生出来的，泄露一台设备的密钥不会影响其它设备
+func aesGCMEncrypt(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func aesGCMDecrypt(key, cipherText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherText) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ct := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, nil)
+}
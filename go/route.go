@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/doraemonkeys/clipboard-go/language"
 	"github.com/sirupsen/logrus"
@@ -35,6 +36,10 @@ const (
 	ErrorInvalidData = "invalid data"
 	// 不完整的数据
 	ErrorIncompleteData = "incomplete data"
+	// 设备已被吊销或已过期，区别于普通的认证失败，见 pairing.go
+	ErrorDeviceForbidden = "device revoked or expired"
+	// 权限不足
+	ErrorPermissionDenied = "permission denied"
 )
 
 const (
@@ -45,6 +50,23 @@ const (
 	downloadAction  = "download"
 	matchAction     = "match"
 	webIp           = "web"
+
+	createUploadSessionAction = "createUploadSession"
+	uploadChunkAction         = "uploadChunk"
+	abortSessionAction        = "abortSession"
+	listSessionsAction        = "listSessions"
+
+	createDownloadSessionAction = "createDownloadSession"
+	downloadChunkAction         = "downloadChunk"
+
+	downloadArchiveAction = "downloadArchive"
+
+	listAction = "list"
+
+	listDevicesAction          = "listDevices"
+	renameDeviceAction         = "renameDevice"
+	revokeDeviceAction         = "revokeDevice"
+	setDevicePermissionsAction = "setDevicePermissions"
 )
 
 type headInfo struct {
@@ -65,6 +87,31 @@ type headInfo struct {
 	// 此次操作想要上传的文件数量
 	FilesCountInThisOp int `json:"filesCountInThisOp"`
 	// Msg      string `json:"msg"`
+
+	// 分片会话相关字段，参见 session.go
+	SessionID   string `json:"sessionID"`
+	ChunkSize   int64  `json:"chunkSize"`
+	ChunkIndex  int    `json:"chunkIndex"`
+	ChunkOffset int64  `json:"chunkOffset"`
+	ChunkLen    int64  `json:"chunkLen"`
+	ChunkSHA256 string `json:"chunkSHA256"`
+	FileSHA256  string `json:"fileSHA256"`
+
+	// 归档下载相关字段，参见 archive.go
+	ArchiveFormat string `json:"archiveFormat"`
+	Compression   string `json:"compression"`
+
+	// 客户端已知的文本编码，非空时跳过自动检测，参见 encoding.go
+	SourceEncoding string `json:"sourceEncoding"`
+
+	// listAction 的排序与过滤条件，参见 browse.go
+	SortBy string `json:"sortBy"`
+	Filter string `json:"filter"`
+
+	// 配对设备相关字段，参见 pairing.go
+	DeviceID        string             `json:"deviceID"`
+	ClientPublicKey string             `json:"clientPublicKey"`
+	Permissions     *DevicePermissions `json:"permissions,omitempty"`
 }
 
 type RespHead struct {
@@ -76,6 +123,18 @@ type RespHead struct {
 	// 如果body有数据，返回数据的长度
 	DataLen int64      `json:"dataLen"`
 	Paths   []pathInfo `json:"paths"`
+
+	// 分片会话相关字段，参见 session.go
+	SessionID     string        `json:"sessionID,omitempty"`
+	ChunkSize     int64         `json:"chunkSize,omitempty"`
+	MissingRanges []chunkRange  `json:"missingRanges,omitempty"`
+	Sessions      []SessionInfo `json:"sessions,omitempty"`
+
+	// listAction 返回的目录条目，参见 browse.go
+	Entries []browseEntry `json:"entries,omitempty"`
+
+	// listDevicesAction 返回的配对设备摘要，参见 pairing.go
+	Devices []DeviceInfo `json:"devices,omitempty"`
 }
 
 type pathInfo struct {
@@ -94,8 +153,13 @@ const (
 )
 
 type MatchActionResp struct {
-	DeviceName   string `json:"deviceName"`
-	SecretKeyHex string `json:"secretKeyHex"`
+	DeviceName string `json:"deviceName"`
+	// 仅用于未完成迁移的旧客户端；新客户端应走下面的 X25519 配对字段
+	SecretKeyHex string `json:"secretKeyHex,omitempty"`
+
+	// 新配对协议：服务端 X25519 公钥 + 分配的设备 ID，真正的对称密钥由双方各自通过 HKDF 派生，不在网络上传输
+	ServerPublicKey string `json:"serverPublicKey,omitempty"`
+	DeviceID        string `json:"deviceID,omitempty"`
 }
 
 const (
@@ -103,8 +167,19 @@ const (
 	DataTypeClipImage = "clip-image"
 	DataTypeFilePaths = "files"
 	DataTypeBinary    = "binary"
+	DataTypeArchive   = "archive"
 )
 
+// 归档压缩方式，见 archive.go
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// 流式传输（如归档）不预先已知长度时，DataLen 置为该值
+const DataLenStreaming = -1
+
 var panicWriter = NewLazyFileWriter("panic.log")
 
 func mainProcess(conn net.Conn) {
@@ -140,6 +215,30 @@ func mainProcess(conn net.Conn) {
 		case matchAction:
 			matchHandler(conn, head)
 			return
+		case createUploadSessionAction:
+			ok = createUploadSessionHandler(conn, head)
+		case uploadChunkAction:
+			ok = uploadChunkHandler(conn, head)
+		case abortSessionAction:
+			ok = abortSessionHandler(conn, head)
+		case listSessionsAction:
+			ok = listSessionsHandler(conn, head)
+		case createDownloadSessionAction:
+			ok = createDownloadSessionHandler(conn, head)
+		case downloadChunkAction:
+			ok = downloadChunkHandler(conn, head)
+		case downloadArchiveAction:
+			ok = downloadArchiveHandler(conn, head)
+		case listAction:
+			ok = listHandler(conn, head)
+		case listDevicesAction:
+			ok = listDevicesHandler(conn, head)
+		case renameDeviceAction:
+			ok = renameDeviceHandler(conn, head)
+		case revokeDeviceAction:
+			ok = revokeDeviceHandler(conn, head)
+		case setDevicePermissionsAction:
+			ok = setPermissionsHandler(conn, head)
 		default:
 			respCommonError(conn, "unknown action:"+head.Action)
 			logrus.Error("unknown action:", head.Action)
@@ -162,13 +261,36 @@ func pasteTextHandler(conn net.Conn, head headInfo) {
 		respCommonError(conn, ErrorIncompleteData+": "+err.Error())
 		return
 	}
+
+	detectedEncoding := ""
+	if head.SourceEncoding != "" {
+		// 客户端声明了编码时按声明转码，不受 DisableEncodingDetect 影响
+		bodyBuf, err = decodeAs(bodyBuf, head.SourceEncoding)
+		if err != nil {
+			logrus.Error("decode as declared encoding error: ", err)
+		} else {
+			detectedEncoding = head.SourceEncoding
+		}
+	} else if GloballCnf.DisableEncodingDetect {
+		// 配置关闭了自动检测，未声明编码的文本按 UTF-8 原样处理
+	} else if !utf8.Valid(bodyBuf) {
+		bodyBuf, detectedEncoding, err = detectAndConvertToUTF8(bodyBuf)
+		if err != nil {
+			logrus.Error("detect encoding error: ", err)
+		}
+	}
+
 	clipboard.Write(clipboard.FmtText, bodyBuf)
 
 	var completionSignal = make(chan struct{})
 
 	go func() {
 		// time.Sleep(time.Millisecond * 100)
-		sendMsg(conn, "粘贴成功")
+		msg := "粘贴成功"
+		if detectedEncoding != "" {
+			msg += "（检测到编码：" + detectedEncoding + "）"
+		}
+		sendMsg(conn, msg)
 		completionSignal <- struct{}{}
 	}()
 
@@ -238,6 +360,7 @@ func readHead(conn net.Conn) (headInfo, error) {
 
 func commonAuth(conn net.Conn) (headInfo, bool) {
 	const unauthorizedCode = 401
+	const forbiddenCode = 403
 	logrus.Debugln("commonAuth remote addr:", conn.RemoteAddr().String())
 
 	head, err := readHead(conn)
@@ -268,7 +391,29 @@ func commonAuth(conn net.Conn) (headInfo, bool) {
 		respError(conn, unauthorizedCode, err.Error())
 		return head, false
 	}
-	decrypted, err := crypter.Decrypt(timeAndIPBytes)
+
+	device, usesPairedKey := lookupActiveDevice(head.DeviceID)
+	if head.DeviceID != "" && !usesPairedKey {
+		respError(conn, forbiddenCode, ErrorDeviceForbidden)
+		return head, false
+	}
+	// 设备管理面 action 必须来自一台被显式授予 CanAdmin 的配对设备；持有旧版全局密钥的调用方
+	// 没有设备身份，deviceAllows 对它们根本不会被调用，这里单独兜底，否则旧密钥也能重命名/吊销任意设备
+	if isAdminAction(head.Action) && !usesPairedKey {
+		respError(conn, forbiddenCode, ErrorPermissionDenied)
+		return head, false
+	}
+	if usesPairedKey && !deviceAllows(device, head) {
+		respError(conn, forbiddenCode, ErrorPermissionDenied)
+		return head, false
+	}
+
+	var decrypted []byte
+	if usesPairedKey {
+		decrypted, err = aesGCMDecrypt(device.SharedKey, timeAndIPBytes)
+	} else {
+		decrypted, err = crypter.Decrypt(timeAndIPBytes)
+	}
 	if err != nil {
 		respError(conn, unauthorizedCode, err.Error())
 		return head, false
@@ -304,13 +449,30 @@ func commonAuth(conn net.Conn) (headInfo, bool) {
 		respError(conn, unauthorizedCode, fmt.Sprintf("ip not match: %s != %s", ip, myipv4))
 		return head, false
 	}
+	if usesPairedKey {
+		touchDeviceLastSeen(device.ID)
+	}
 	return head, true
 }
 
 func matchHandler(conn net.Conn, head headInfo) {
-	resp := MatchActionResp{
-		DeviceName:   GetDeviceName(),
-		SecretKeyHex: GloballCnf.SecretKeyHex,
+	var resp MatchActionResp
+	if head.ClientPublicKey == "" {
+		// 旧客户端不携带 X25519 公钥，继续发全局密钥；commonAuth 里 head.DeviceID 为空时
+		// 会退回 crypter 校验，因此新旧协议可以在迁移期共存，见 pairing.go
+		resp = MatchActionResp{
+			DeviceName:   GetDeviceName(),
+			SecretKeyHex: GloballCnf.SecretKeyHex,
+		}
+	} else {
+		var err error
+		resp, err = pairDevice(head)
+		if err != nil {
+			logrus.Error("pair device error: ", err)
+			respCommonError(conn, err.Error())
+			closeAllowSearchCH <- struct{}{}
+			return
+		}
 	}
 	respBuf, err := json.Marshal(resp)
 	if err != nil {
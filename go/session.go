@@ -0,0 +1,603 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uploadSaveDir 是分片会话临时文件及最终落盘文件的根目录，与 downloadHandler 保存文件用的目录保持一致
+var uploadSaveDir = "."
+
+// 单次小文件直传阈值，小于该大小的文件直接走 pasteFileAction，不建立分片会话
+const singleShotMaxFileSize = 4 * 1024 * 1024 // 4MiB
+
+// 默认分片大小
+const defaultChunkSize = 10 * 1024 * 1024 // 10MiB
+
+// maxChunkSize 是协商 ChunkSize 时允许的服务端上限。客户端请求的 ChunkSize 只是协商输入，
+// 不是服务端必须照办的承诺——超过这个上限会被压到这个值，否则恶意/失控的客户端可以谈出一个
+// 几 GB 的分片大小，再借上传/下载分片读写把服务端的单次内存分配撑到同等大小，分片协议本该
+// 提供的"内存占用有界"就名存实亡了
+const maxChunkSize = 64 * 1024 * 1024 // 64MiB
+
+// 会话过期时间，按 CreatedAt 计算，创建后超过该时间仍在 map 里的会话会被 reaper 清理
+const sessionExpire = 24 * time.Hour
+
+// chunkRange 表示一个左闭右开的字节区间 [Start, End)
+type chunkRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// SessionInfo 是 listSessionsAction 返回给客户端的会话摘要
+type SessionInfo struct {
+	SessionID string    `json:"sessionID"`
+	FileSize  int64     `json:"fileSize"`
+	Received  int64     `json:"received"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// uploadSession 记录一次断点续传上传的进度，落盘到 <file>.partial.json 作为 journal
+type uploadSession struct {
+	mu sync.Mutex
+
+	SessionID string `json:"sessionID"`
+	// DeviceID 记录发起 createUploadSessionAction 的设备，空字符串表示走旧版全局密钥创建；
+	// abortSessionHandler/listSessionsHandler 靠它判断一次 abortSessionAction/listSessionsAction
+	// 请求能不能动/看到这个会话，而不是像最初那样谁都能摆弄任何 SessionID
+	DeviceID   string       `json:"deviceID"`
+	TempPath   string       `json:"tempPath"`
+	FinalPath  string       `json:"finalPath"`
+	FileSize   int64        `json:"fileSize"`
+	FileSHA256 string       `json:"fileSHA256"`
+	ChunkSize  int64        `json:"chunkSize"`
+	Received   []chunkRange `json:"received"`
+	CreatedAt  time.Time    `json:"createdAt"`
+}
+
+func (s *uploadSession) journalPath() string {
+	return s.TempPath + ".partial.json"
+}
+
+func (s *uploadSession) saveJournal() error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.journalPath(), buf, 0644)
+}
+
+// missing 按升序返回尚未收到的区间
+func (s *uploadSession) missing() []chunkRange {
+	ranges := append([]chunkRange(nil), s.Received...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	var missing []chunkRange
+	var cursor int64
+	for _, r := range ranges {
+		if r.Start > cursor {
+			missing = append(missing, chunkRange{Start: cursor, End: r.Start})
+		}
+		if r.End > cursor {
+			cursor = r.End
+		}
+	}
+	if cursor < s.FileSize {
+		missing = append(missing, chunkRange{Start: cursor, End: s.FileSize})
+	}
+	return missing
+}
+
+// addReceived 合并一个新收到的区间，返回是否已经收到了整个文件
+func (s *uploadSession) addReceived(start, end int64) bool {
+	s.Received = append(s.Received, chunkRange{Start: start, End: end})
+	sort.Slice(s.Received, func(i, j int) bool { return s.Received[i].Start < s.Received[j].Start })
+
+	merged := s.Received[:0]
+	for _, r := range s.Received {
+		if len(merged) > 0 && r.Start <= merged[len(merged)-1].End {
+			if r.End > merged[len(merged)-1].End {
+				merged[len(merged)-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.Received = merged
+	return len(merged) == 1 && merged[0].Start == 0 && merged[0].End == s.FileSize
+}
+
+var (
+	uploadSessionsMu sync.Mutex
+	uploadSessions   = make(map[string]*uploadSession)
+)
+
+// resolveUploadPath 把客户端声明的相对路径解析到 uploadSaveDir 之下，拒绝 ".." 或绝对路径等越权写入
+func resolveUploadPath(relPath string) (string, error) {
+	if relPath == "" {
+		return "", errors.New("empty path")
+	}
+	if filepath.IsAbs(relPath) {
+		return "", errors.New("absolute path not allowed: " + relPath)
+	}
+	cleaned := filepath.Clean(relPath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", errors.New("path escapes upload dir: " + relPath)
+	}
+
+	rootAbs, err := filepath.Abs(uploadSaveDir)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(rootAbs, cleaned)
+	if full != rootAbs && !strings.HasPrefix(full, rootAbs+string(filepath.Separator)) {
+		return "", errors.New("path escapes upload dir: " + relPath)
+	}
+	return full, nil
+}
+
+func newSessionID() string {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		// 极小概率走到这里，退化为时间戳，仍然保证同一时刻内唯一性足够低碰撞
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// createUploadSessionHandler 处理 createUploadSessionAction，协商 ChunkSize 并返回 SessionID
+func createUploadSessionHandler(conn net.Conn, head headInfo) bool {
+	if head.FileSize <= 0 {
+		return respCommonError(conn, "invalid fileSize")
+	}
+	if head.FileSize < singleShotMaxFileSize {
+		return respCommonError(conn, "file too small for a chunked session, use "+pasteFileAction)
+	}
+	chunkSize := head.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	} else if chunkSize > maxChunkSize {
+		chunkSize = maxChunkSize
+	}
+
+	finalPath, err := resolveUploadPath(head.Path)
+	if err != nil {
+		return respCommonError(conn, err.Error())
+	}
+
+	sid := newSessionID()
+	tempPath, err := resolveUploadPath(sid + ".tmp")
+	if err != nil {
+		return respCommonError(conn, err.Error())
+	}
+
+	session := &uploadSession{
+		SessionID:  sid,
+		DeviceID:   head.DeviceID,
+		TempPath:   tempPath,
+		FinalPath:  finalPath,
+		FileSize:   head.FileSize,
+		FileSHA256: head.FileSHA256,
+		ChunkSize:  chunkSize,
+		CreatedAt:  time.Now(),
+	}
+
+	// 创建稀疏临时文件
+	f, err := os.OpenFile(session.TempPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		logrus.Error("create temp file error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+	if err := f.Truncate(head.FileSize); err != nil {
+		f.Close()
+		logrus.Error("truncate temp file error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+	f.Close()
+
+	if err := session.saveJournal(); err != nil {
+		logrus.Error("save journal error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+
+	uploadSessionsMu.Lock()
+	uploadSessions[sid] = session
+	uploadSessionsMu.Unlock()
+
+	var resp RespHead
+	resp.Code = 200
+	resp.SessionID = sid
+	resp.ChunkSize = chunkSize
+	if err := sendHead(conn, resp); err != nil {
+		return false
+	}
+	return true
+}
+
+// uploadChunkHandler 处理 uploadChunkAction，写入一个分片并在收齐后校验整体 SHA-256、原子落盘
+func uploadChunkHandler(conn net.Conn, head headInfo) bool {
+	uploadSessionsMu.Lock()
+	session, ok := uploadSessions[head.SessionID]
+	uploadSessionsMu.Unlock()
+	if !ok {
+		respCommonError(conn, "unknown session: "+head.SessionID)
+		// 仍然需要把本次分片的 body 读走，否则协议会错位
+		io.CopyN(io.Discard, conn, head.ChunkLen)
+		return false
+	}
+
+	if head.ChunkLen <= 0 || head.ChunkLen > session.ChunkSize {
+		respCommonError(conn, "invalid chunkLen: "+fmt.Sprint(head.ChunkLen))
+		// 仍然需要把本次分片的 body 读走（按客户端声明的长度，不是我们愿意分配的长度），否则协议会错位
+		io.CopyN(io.Discard, conn, head.ChunkLen)
+		return false
+	}
+	// 分片必须落在建会话时声明的文件范围内，否则客户端可以用任意 ChunkOffset 把稀疏临时文件撑到
+	// 无限大，顺带绕过 deviceAllows 在 createUploadSessionAction 时对 head.FileSize 做的
+	// MaxFileSize 检查——那个检查只看客户端声明的大小，不看实际写了多少字节
+	if head.ChunkOffset < 0 || head.ChunkOffset+head.ChunkLen > session.FileSize {
+		respCommonError(conn, "chunk range exceeds declared file size")
+		io.CopyN(io.Discard, conn, head.ChunkLen)
+		return false
+	}
+
+	chunkBuf := make([]byte, head.ChunkLen)
+	if _, err := io.ReadFull(conn, chunkBuf); err != nil {
+		logrus.Error("read chunk body error: ", err)
+		return respCommonError(conn, ErrorIncompleteData+": "+err.Error())
+	}
+
+	sum := sha256.Sum256(chunkBuf)
+	if hex.EncodeToString(sum[:]) != head.ChunkSHA256 {
+		return respCommonError(conn, "chunk checksum mismatch, index:"+fmt.Sprint(head.ChunkIndex))
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	f, err := os.OpenFile(session.TempPath, os.O_WRONLY, 0644)
+	if err != nil {
+		logrus.Error("open temp file error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+	_, err = f.WriteAt(chunkBuf, head.ChunkOffset)
+	f.Close()
+	if err != nil {
+		logrus.Error("write chunk error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+
+	complete := session.addReceived(head.ChunkOffset, head.ChunkOffset+head.ChunkLen)
+	if err := session.saveJournal(); err != nil {
+		logrus.Error("save journal error: ", err)
+	}
+
+	if complete {
+		if err := finalizeUploadSession(session); err != nil {
+			logrus.Error("finalize session error: ", err)
+			return respCommonError(conn, ErrorInvalidData+": "+err.Error())
+		}
+		uploadSessionsMu.Lock()
+		delete(uploadSessions, session.SessionID)
+		uploadSessionsMu.Unlock()
+
+		var resp RespHead
+		resp.Code = 200
+		resp.Msg = "upload complete"
+		return sendHead(conn, resp) == nil
+	}
+
+	var resp RespHead
+	resp.Code = 200
+	resp.MissingRanges = session.missing()
+	return sendHead(conn, resp) == nil
+}
+
+// finalizeUploadSession 校验整体 SHA-256 并原子重命名到最终路径
+func finalizeUploadSession(session *uploadSession) error {
+	f, err := os.Open(session.TempPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if session.FileSHA256 != "" && got != session.FileSHA256 {
+		return errors.New("file checksum mismatch, expected:" + session.FileSHA256 + " got:" + got)
+	}
+	if err := os.Rename(session.TempPath, session.FinalPath); err != nil {
+		return err
+	}
+	os.Remove(session.journalPath())
+	return nil
+}
+
+// abortSessionHandler 处理 abortSessionAction，删除上传或下载会话；下载会话从 downloadSessions 里摘除，
+// 标了 Ephemeral 的归档会话连同临时归档文件一起删除。只有创建会话的那台设备能中止它——否则任何配对设备都能
+// 凭猜到/侧信道拿到的 SessionID 去中止别的设备正在进行的传输
+func abortSessionHandler(conn net.Conn, head headInfo) bool {
+	uploadSessionsMu.Lock()
+	session, ok := uploadSessions[head.SessionID]
+	if ok && session.DeviceID != head.DeviceID {
+		uploadSessionsMu.Unlock()
+		return respError(conn, 403, ErrorPermissionDenied)
+	}
+	if ok {
+		delete(uploadSessions, head.SessionID)
+	}
+	uploadSessionsMu.Unlock()
+	if ok {
+		os.Remove(session.TempPath)
+		os.Remove(session.journalPath())
+		return sendMsg(conn, "session aborted") == nil
+	}
+
+	downloadSessionsMu.Lock()
+	dlSession, ok := downloadSessions[head.SessionID]
+	if ok && dlSession.DeviceID != head.DeviceID {
+		downloadSessionsMu.Unlock()
+		return respError(conn, 403, ErrorPermissionDenied)
+	}
+	if ok {
+		delete(downloadSessions, head.SessionID)
+	}
+	downloadSessionsMu.Unlock()
+	if !ok {
+		return respCommonError(conn, "unknown session: "+head.SessionID)
+	}
+	if dlSession.Ephemeral {
+		os.Remove(dlSession.Path)
+	}
+	return sendMsg(conn, "session aborted") == nil
+}
+
+// listSessionsHandler 处理 listSessionsAction，返回*调用方自己*创建的未完成会话；同一 DeviceID
+// 之外的会话不应该出现在这里，否则一台设备就能看到其它设备正在传输的文件名/大小/进度
+func listSessionsHandler(conn net.Conn, head headInfo) bool {
+	uploadSessionsMu.Lock()
+	var resp RespHead
+	resp.Code = 200
+	for _, session := range uploadSessions {
+		if session.DeviceID != head.DeviceID {
+			continue
+		}
+		session.mu.Lock()
+		var received int64
+		for _, r := range session.Received {
+			received += r.End - r.Start
+		}
+		session.mu.Unlock()
+		resp.Sessions = append(resp.Sessions, SessionInfo{
+			SessionID: session.SessionID,
+			FileSize:  session.FileSize,
+			Received:  received,
+			CreatedAt: session.CreatedAt,
+		})
+	}
+	uploadSessionsMu.Unlock()
+	return sendHead(conn, resp) == nil
+}
+
+// downloadSession 记录一次断点续传下载所针对的源文件，支持客户端按 ChunkOffset/ChunkLen 分段拉取
+type downloadSession struct {
+	SessionID string
+	// DeviceID 记录发起 createDownloadSessionAction/downloadArchiveAction 的设备，语义和
+	// uploadSession.DeviceID 一致，空字符串表示走旧版全局密钥创建
+	DeviceID   string
+	Path       string
+	FileSize   int64
+	FileSHA256 string
+	ChunkSize  int64
+	CreatedAt  time.Time
+	// Ephemeral 标记 Path 是服务端为这次会话生成的临时文件（目前只有 archive.go 打包的归档），
+	// 会话结束/过期时要把文件一并删掉；普通下载会话的 Path 是用户自己的文件，绝不能被删
+	Ephemeral bool
+}
+
+var (
+	downloadSessionsMu sync.Mutex
+	downloadSessions   = make(map[string]*downloadSession)
+)
+
+// createDownloadSessionHandler 处理 createDownloadSessionAction：校验 head.Path 落在 allowedBrowseRoots
+// 白名单之下（和 listHandler 一样，见 browse.go 的 resolveAllowedPath），再校验文件存在、计算整体 SHA-256，
+// 建立一个可以断线重连、按区间续传的下载会话，镜像上传侧的 createUploadSessionAction
+func createDownloadSessionHandler(conn net.Conn, head headInfo) bool {
+	path, err := resolveAllowedPath(head.Path)
+	if err != nil {
+		return respCommonError(conn, err.Error())
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return respCommonError(conn, "invalid path: "+head.Path)
+	}
+
+	sum, err := sha256File(path)
+	if err != nil {
+		logrus.Error("hash download file error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+
+	chunkSize := head.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	} else if chunkSize > maxChunkSize {
+		chunkSize = maxChunkSize
+	}
+
+	sid := newSessionID()
+	downloadSessionsMu.Lock()
+	downloadSessions[sid] = &downloadSession{
+		SessionID:  sid,
+		DeviceID:   head.DeviceID,
+		Path:       path,
+		FileSize:   info.Size(),
+		FileSHA256: sum,
+		ChunkSize:  chunkSize,
+		CreatedAt:  time.Now(),
+	}
+	downloadSessionsMu.Unlock()
+
+	var resp RespHead
+	resp.Code = 200
+	resp.SessionID = sid
+	resp.ChunkSize = chunkSize
+	resp.DataLen = info.Size()
+	resp.Msg = sum
+	return sendHead(conn, resp) == nil
+}
+
+// downloadChunkHandler 处理 downloadChunkAction，按 ChunkOffset/ChunkLen 读取源文件的一个区间并回传
+func downloadChunkHandler(conn net.Conn, head headInfo) bool {
+	downloadSessionsMu.Lock()
+	session, ok := downloadSessions[head.SessionID]
+	downloadSessionsMu.Unlock()
+	if !ok {
+		return respCommonError(conn, "unknown session: "+head.SessionID)
+	}
+
+	if head.ChunkOffset < 0 || head.ChunkOffset >= session.FileSize {
+		return respCommonError(conn, "invalid chunk range")
+	}
+	// ChunkLen<=0 表示"服务端决定多大"，和超出协商上限一样，都收敛到 session.ChunkSize——否则
+	// 客户端可以用 ChunkOffset=0,ChunkLen=FileSize 把整个文件当一个"分片"读进内存，分片下载的
+	// 内存上界就形同虚设了
+	chunkLen := head.ChunkLen
+	if chunkLen <= 0 || chunkLen > session.ChunkSize {
+		chunkLen = session.ChunkSize
+	}
+	if head.ChunkOffset+chunkLen > session.FileSize {
+		chunkLen = session.FileSize - head.ChunkOffset
+	}
+
+	f, err := os.Open(session.Path)
+	if err != nil {
+		logrus.Error("open download file error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+	defer f.Close()
+
+	buf := make([]byte, chunkLen)
+	if _, err := f.ReadAt(buf, head.ChunkOffset); err != nil && err != io.EOF {
+		logrus.Error("read download chunk error: ", err)
+		return respCommonError(conn, ErrorInternal)
+	}
+
+	sum := sha256.Sum256(buf)
+	var resp RespHead
+	resp.Code = 200
+	resp.DataType = DataTypeBinary
+	resp.DataLen = int64(len(buf))
+	resp.Msg = hex.EncodeToString(sum[:])
+	if err := sendHead(conn, resp); err != nil {
+		return false
+	}
+	if _, err := conn.Write(buf); err != nil {
+		logrus.Error("write download chunk error: ", err)
+		return false
+	}
+	return true
+}
+
+// loadUploadSessions 启动时从 uploadSaveDir 里的 *.tmp.partial.json 恢复尚未完成的会话，
+// 否则重启一次就会丢光所有进度并留下孤儿临时文件，"重连后可续传"就名不副实了
+func loadUploadSessions() error {
+	entries, err := os.ReadDir(uploadSaveDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".partial.json") {
+			continue
+		}
+		journalPath := filepath.Join(uploadSaveDir, e.Name())
+		buf, err := os.ReadFile(journalPath)
+		if err != nil {
+			logrus.Error("read journal error: ", err)
+			continue
+		}
+		var session uploadSession
+		if err := json.Unmarshal(buf, &session); err != nil {
+			logrus.Error("unmarshal journal error: ", err)
+			continue
+		}
+		if _, err := os.Stat(session.TempPath); err != nil {
+			logrus.Warn("journal without temp file, discarding: ", journalPath)
+			os.Remove(journalPath)
+			continue
+		}
+		uploadSessionsMu.Lock()
+		uploadSessions[session.SessionID] = &session
+		uploadSessionsMu.Unlock()
+	}
+	return nil
+}
+
+// sessionReaper 周期性清理长时间未完成的会话
+func sessionReaper() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		uploadSessionsMu.Lock()
+		for sid, session := range uploadSessions {
+			if time.Since(session.CreatedAt) > sessionExpire {
+				logrus.Info("reaping expired upload session: ", sid)
+				os.Remove(session.TempPath)
+				os.Remove(session.journalPath())
+				delete(uploadSessions, sid)
+			}
+		}
+		uploadSessionsMu.Unlock()
+	}
+}
+
+// downloadSessionReaper 周期性清理长时间未被取走的下载会话：普通下载会话只需要把 map 条目摘掉
+// （Path 是用户自己的文件，不能删）；archive.go 打包出来的归档会话标了 Ephemeral，要连同临时文件一起删，
+// 否则没人取走的归档会永远占着磁盘——这就是 sessionReaper 对 uploadSessions 做的事，在下载侧的镜像
+func downloadSessionReaper() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		downloadSessionsMu.Lock()
+		for sid, session := range downloadSessions {
+			if time.Since(session.CreatedAt) > sessionExpire {
+				logrus.Info("reaping expired download session: ", sid)
+				if session.Ephemeral {
+					os.Remove(session.Path)
+				}
+				delete(downloadSessions, sid)
+			}
+		}
+		downloadSessionsMu.Unlock()
+	}
+}
+
+func init() {
+	if err := loadUploadSessions(); err != nil {
+		logrus.Error("load upload sessions error: ", err)
+	}
+	go sessionReaper()
+	go downloadSessionReaper()
+}